@@ -0,0 +1,386 @@
+/*
+	Copyright (C) 2021-2022  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChatFilter is a link in the moderation chain that processMsg runs on gsay
+// and psay messages before handleGSay or handlePSay broadcasts them. allowed
+// is false if the message
+// should be dropped entirely; replacement, when non-empty, is broadcast in
+// the message's place instead (e.g. a profanity mask).
+type ChatFilter interface {
+	Check(sender *SessionClient, message string) (allowed bool, replacement string, reason string)
+}
+
+// chatFilterChain runs each configured ChatFilter in order and stops at the
+// first one that denies the message.
+var chatFilterChain []ChatFilter
+
+// checkChatFilters runs message through the chain and, if denied, notifies
+// sender with a `mod` message carrying the reason.
+func checkChatFilters(sender *SessionClient, message string) (allowed bool, out string) {
+	out = message
+
+	for _, filter := range chatFilterChain {
+		ok, replacement, reason := filter.Check(sender, out)
+		if !ok {
+			sender.sendMsg("mod", "denied", reason)
+			return false, ""
+		}
+		if replacement != "" {
+			out = replacement
+		}
+	}
+
+	return true, out
+}
+
+// ProfanityFilter masks words from a word list loaded from disk, matching
+// case- and leetspeak-normalized forms (e.g. "pr0fan1ty" matches "profanity").
+type ProfanityFilter struct {
+	mu    sync.RWMutex
+	path  string
+	words map[string]bool
+}
+
+var leetNormalizer = strings.NewReplacer(
+	"0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s",
+)
+
+func NewProfanityFilter(path string) (*ProfanityFilter, error) {
+	f := &ProfanityFilter{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *ProfanityFilter) Reload() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	words := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		words[normalizeForProfanity(word)] = true
+	}
+
+	f.mu.Lock()
+	f.words = words
+	f.mu.Unlock()
+
+	return scanner.Err()
+}
+
+func normalizeForProfanity(s string) string {
+	return leetNormalizer.Replace(strings.ToLower(s))
+}
+
+func (f *ProfanityFilter) Check(sender *SessionClient, message string) (bool, string, string) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	normalized := normalizeForProfanity(message)
+	masked := []byte(message)
+	hit := false
+
+	// normalizeForProfanity is length-preserving (lower-casing and leetspeak
+	// folding are both one-byte-for-one-byte for ASCII), so offsets found in
+	// normalized map directly onto masked regardless of the original casing
+	// or leetspeak substitutions used to evade the word list.
+	for word := range f.words {
+		start := 0
+		for {
+			idx := strings.Index(normalized[start:], word)
+			if idx == -1 {
+				break
+			}
+			idx += start
+
+			hit = true
+			for i := idx; i < idx+len(word); i++ {
+				masked[i] = '*'
+			}
+
+			start = idx + len(word)
+		}
+	}
+
+	if hit {
+		return true, string(masked), ""
+	}
+
+	return true, "", ""
+}
+
+// URLFilter denies messages containing links or chat/server invites, which
+// are almost always spam or phishing in this context.
+type URLFilter struct {
+	pattern *regexp.Regexp
+}
+
+func NewURLFilter() *URLFilter {
+	return &URLFilter{pattern: regexp.MustCompile(`(?i)(https?://|www\.|discord\.gg/)`)}
+}
+
+func (f *URLFilter) Check(sender *SessionClient, message string) (bool, string, string) {
+	if f.pattern.MatchString(message) {
+		return false, "", "links and invites aren't allowed in chat"
+	}
+
+	return true, "", ""
+}
+
+// DuplicateFloodFilter denies a message repeated threshold times within
+// window by the same sender, regardless of other chat content in between.
+type DuplicateFloodFilter struct {
+	threshold int
+	window    time.Duration
+
+	mu      sync.Mutex
+	history map[string][]floodEntry
+}
+
+type floodEntry struct {
+	message string
+	at      time.Time
+}
+
+func NewDuplicateFloodFilter(threshold int, window time.Duration) *DuplicateFloodFilter {
+	f := &DuplicateFloodFilter{threshold: threshold, window: window, history: make(map[string][]floodEntry)}
+	go f.sweepLoop()
+
+	return f
+}
+
+// sweepLoop drops uuids whose entries have all aged out of the window, so a
+// player who chats once and never again doesn't leak a map entry forever.
+func (f *DuplicateFloodFilter) sweepLoop() {
+	ticker := time.NewTicker(f.window)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+
+		f.mu.Lock()
+		for uuid, entries := range f.history {
+			stale := true
+			for _, e := range entries {
+				if now.Sub(e.at) <= f.window {
+					stale = false
+					break
+				}
+			}
+			if stale {
+				delete(f.history, uuid)
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (f *DuplicateFloodFilter) Check(sender *SessionClient, message string) (bool, string, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	entries := f.history[sender.uuid]
+
+	var kept []floodEntry
+	var matches int
+	for _, e := range entries {
+		if now.Sub(e.at) > f.window {
+			continue
+		}
+		kept = append(kept, e)
+		if e.message == message {
+			matches++
+		}
+	}
+
+	kept = append(kept, floodEntry{message: message, at: now})
+	f.history[sender.uuid] = kept
+
+	if matches+1 >= f.threshold {
+		return false, "", "please stop repeating the same message"
+	}
+
+	return true, "", ""
+}
+
+// WebhookFilter defers the allow/deny decision to an external HTTP service,
+// POSTing the message and sender uuid and expecting an allow/deny/replacement
+// JSON response back.
+type WebhookFilter struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookFilter(url string) *WebhookFilter {
+	return &WebhookFilter{url: url, client: &http.Client{Timeout: 2 * time.Second}}
+}
+
+type webhookRequest struct {
+	Uuid    string `json:"uuid"`
+	Message string `json:"message"`
+}
+
+type webhookResponse struct {
+	Allow       bool   `json:"allow"`
+	Replacement string `json:"replacement"`
+	Reason      string `json:"reason"`
+}
+
+func (f *WebhookFilter) Check(sender *SessionClient, message string) (bool, string, string) {
+	body, err := json.Marshal(webhookRequest{Uuid: sender.uuid, Message: message})
+	if err != nil {
+		return true, "", ""
+	}
+
+	resp, err := f.client.Post(f.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// fail open: a dead webhook shouldn't silence global chat
+		return true, "", ""
+	}
+	defer resp.Body.Close()
+
+	var out webhookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return true, "", ""
+	}
+
+	return out.Allow, out.Replacement, out.Reason
+}
+
+// rankAdmin is the minimum client.rank required to call the admin endpoints
+// below, mirroring the rank already resolved from a player's token in
+// addClient (session.go).
+const rankAdmin = 2
+
+// requireAdmin rejects the request unless its token resolves to an
+// admin-ranked player. Every admin handler in this file must be wrapped with
+// it before being registered with a router.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, _, rank, _, banned, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
+		if banned || rank < rankAdmin {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// handleAdminReloadFilters lets admins reload word lists at runtime instead
+// of restarting the process.
+func handleAdminReloadFilters(w http.ResponseWriter, r *http.Request) {
+	for _, filter := range chatFilterChain {
+		if pf, ok := filter.(*ProfanityFilter); ok {
+			if err := pf.Reload(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAdminMute sets a player's muted or shadowmuted state, persisted
+// alongside the existing `muted` column so it survives reconnects. A
+// shadowmuted player's messages are accepted and echoed back to them but
+// never broadcast to anyone else.
+func handleAdminMute(w http.ResponseWriter, r *http.Request) {
+	uuid := r.URL.Query().Get("uuid")
+	if uuid == "" {
+		http.Error(w, "uuid required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Query().Get("mode") {
+	case "mute":
+		setPlayerMuted(uuid, true)
+	case "unmute":
+		setPlayerMuted(uuid, false)
+	case "shadowmute":
+		setPlayerShadowmuted(uuid, true)
+	case "unshadowmute":
+		setPlayerShadowmuted(uuid, false)
+	default:
+		http.Error(w, "unknown mode", http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// initChatFilters builds chatFilterChain from serverConfig.ChatFilters and
+// registers the admin endpoints behind requireAdmin. Filters with nothing to
+// load from (no word list path, no webhook URL configured) are left out of
+// the chain rather than running as dead weight.
+func initChatFilters() {
+	var chain []ChatFilter
+
+	if path := serverConfig.ChatFilters.ProfanityListPath; path != "" {
+		profanity, err := NewProfanityFilter(path)
+		if err != nil {
+			log.Println("chatfilter: failed to load profanity list, skipping:", err)
+		} else {
+			chain = append(chain, profanity)
+		}
+	}
+
+	if serverConfig.ChatFilters.BlockUrls {
+		chain = append(chain, NewURLFilter())
+	}
+
+	if serverConfig.ChatFilters.DuplicateFloodThreshold > 0 {
+		window := time.Duration(serverConfig.ChatFilters.DuplicateFloodWindowSeconds) * time.Second
+		chain = append(chain, NewDuplicateFloodFilter(serverConfig.ChatFilters.DuplicateFloodThreshold, window))
+	}
+
+	if url := serverConfig.ChatFilters.WebhookUrl; url != "" {
+		chain = append(chain, NewWebhookFilter(url))
+	}
+
+	chatFilterChain = chain
+
+	http.HandleFunc("/admin/chatfilters/reload", requireAdmin(handleAdminReloadFilters))
+	http.HandleFunc("/admin/mute", requireAdmin(handleAdminMute))
+}
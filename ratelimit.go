@@ -0,0 +1,181 @@
+/*
+	Copyright (C) 2021-2022  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitViolation is a (uuid, msgType) strike, sent to rateLimitMetrics so
+// admins can see who's hitting their buckets and how often.
+type rateLimitViolation struct {
+	Uuid    string    `json:"uuid"`
+	Ip      string    `json:"ip"`
+	MsgType string    `json:"msgType"`
+	Time    time.Time `json:"time"`
+}
+
+var rateLimitMetrics = make(chan rateLimitViolation, 64)
+
+// recentViolations is what handleRateLimit serves; violationWindow caps how
+// long a stale entry sticks around so the slice doesn't grow unbounded.
+const violationWindow = 10 * time.Minute
+
+var (
+	recentViolationsMu sync.Mutex
+	recentViolations   []rateLimitViolation
+)
+
+// initRateLimitMetrics drains rateLimitMetrics into recentViolations. Without
+// a consumer, rateLimitMetrics fills up and rateLimitAllow drops every later
+// violation instead of recording it; this also backs the GET /admin/ratelimit
+// endpoint registered here.
+func initRateLimitMetrics() {
+	go func() {
+		for v := range rateLimitMetrics {
+			recentViolationsMu.Lock()
+			recentViolations = append(recentViolations, v)
+
+			cutoff := time.Now().Add(-violationWindow)
+			var kept []rateLimitViolation
+			for _, e := range recentViolations {
+				if e.Time.After(cutoff) {
+					kept = append(kept, e)
+				}
+			}
+			recentViolations = kept
+			recentViolationsMu.Unlock()
+		}
+	}()
+
+	http.HandleFunc("/admin/ratelimit", requireAdmin(handleRateLimit))
+}
+
+// handleRateLimit lists rate limit violations from the last violationWindow
+// so admins can see who's flooding without grepping logs.
+func handleRateLimit(w http.ResponseWriter, r *http.Request) {
+	cutoff := time.Now().Add(-violationWindow)
+
+	recentViolationsMu.Lock()
+	var violations []rateLimitViolation
+	for _, e := range recentViolations {
+		if e.Time.After(cutoff) {
+			violations = append(violations, e)
+		}
+	}
+	recentViolationsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(violations); err != nil {
+		log.Println("ratelimit: failed to encode violations:", err)
+	}
+}
+
+// clientLimiter holds one token bucket per message-type group for a single
+// SessionClient, plus the strike count behind the escalation (warn -> mute ->
+// disconnect and ban) tracked across repeated violations on this connection.
+type clientLimiter struct {
+	mu       sync.Mutex
+	buckets  map[string]*rate.Limiter
+	strikes  int
+	lastWarn time.Time
+}
+
+// msgTypeGroups maps a processMsg message type to the serverConfig rate
+// limit bucket it draws from, so related message types (gsay/psay) can share
+// a stricter bucket than higher-frequency ones (pt/ep/e).
+var msgTypeGroups = map[string]string{
+	"gsay": "chat",
+	"psay": "chat",
+	"pt":   "movement",
+	"ep":   "movement",
+	"e":    "movement",
+}
+
+func newClientLimiter() *clientLimiter {
+	return &clientLimiter{buckets: make(map[string]*rate.Limiter)}
+}
+
+func (l *clientLimiter) limiterFor(group string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if lim, ok := l.buckets[group]; ok {
+		return lim
+	}
+
+	limits := serverConfig.RateLimits[group]
+	lim := rate.NewLimiter(rate.Limit(limits.PerSecond), limits.Burst)
+	l.buckets[group] = lim
+
+	return lim
+}
+
+// allow checks the bucket for msgType's group and, on exhaustion, escalates
+// sender's standing: the first strike warns, the second mutes through
+// setPlayerMuted (nothing here lifts that mute again), and the third
+// disconnects and bans in one step via the same `banned` path addClient
+// already checks. Message types with no
+// configured group (handshake/metadata types like i/name/ploc) are left
+// unlimited rather than drawing from an unconfigured, zero-capacity bucket.
+func (sender *SessionClient) rateLimitAllow(msgType string) bool {
+	group, ok := msgTypeGroups[msgType]
+	if !ok {
+		return true
+	}
+
+	if sender.limiter.limiterFor(group).Allow() {
+		return true
+	}
+
+	// Non-blocking: rateLimitAllow runs in each client's hot message-processing
+	// path, so a full buffer (initRateLimitMetrics not running, or a burst
+	// larger than it can drain) must drop a metric rather than stall every
+	// client that hits it next.
+	select {
+	case rateLimitMetrics <- rateLimitViolation{Uuid: sender.uuid, Ip: sender.ip, MsgType: msgType, Time: time.Now()}:
+	default:
+		log.Println("ratelimit: metrics buffer full, dropping violation for", sender.uuid)
+	}
+
+	sender.limiter.mu.Lock()
+	sender.limiter.strikes++
+	strikes := sender.limiter.strikes
+	sender.limiter.mu.Unlock()
+
+	switch {
+	case strikes == 1:
+		sender.sendMsg("mod", "warn", "you are sending messages too quickly")
+	case strikes == 2:
+		setPlayerMuted(sender.uuid, true)
+		sender.muted = true
+		sender.sendMsg("mod", "mute", "temporarily muted for flooding")
+	case strikes >= 3:
+		writeErrLog(sender.ip, "session", "disconnected for repeated rate limit violations")
+		banPlayer(sender.uuid, sender.ip)
+		sender.disconnect()
+	}
+
+	return false
+}
@@ -0,0 +1,226 @@
+/*
+	Copyright (C) 2021-2022  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+)
+
+// rankAdmin is the minimum client.rank required to call admin-only endpoints.
+const rankAdmin = 2
+
+// minigameConfig is the shape of one minigame entry read out of
+// minigames.toml, e.g. [[game.2kki.room.102.minigame]].
+type minigameConfig struct {
+	Id             string `toml:"id" json:"minigameId"`
+	VarId          int    `toml:"varId" json:"varId"`
+	InitialVarSync bool   `toml:"initialVarSync" json:"initialVarSync"`
+	SwitchId       int    `toml:"switchId" json:"switchId"`
+	SwitchValue    bool   `toml:"switchValue" json:"switchValue"`
+	Dev            bool   `toml:"dev" json:"dev"`
+}
+
+type minigameFile struct {
+	Game map[string]struct {
+		Room map[string]struct {
+			Minigames []minigameConfig `toml:"minigame"`
+		} `toml:"room"`
+	} `toml:"game"`
+}
+
+// MinigameRegistry replaces the hard-coded GameName/roomId switch in
+// getRoomMinigames with data loaded from minigames.toml, so new minigames can
+// be added without recompiling. It's safe for concurrent reads and reloads.
+type MinigameRegistry struct {
+	mu   sync.RWMutex
+	path string
+	// byGameRoom is keyed by "<game>/<roomId>"
+	byGameRoom map[string][]*Minigame
+}
+
+// LoadMinigames reads path (TOML) and returns a ready-to-use registry. Call
+// Watch afterwards to hot-reload on SIGHUP.
+func LoadMinigames(path string) (*MinigameRegistry, error) {
+	r := &MinigameRegistry{path: path}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// InitMinigames loads minigameRegistry from path, starts its SIGHUP watcher
+// and registers the admin HTTP endpoint. Called once at server startup.
+func InitMinigames(path string) error {
+	registry, err := LoadMinigames(path)
+	if err != nil {
+		return err
+	}
+
+	registry.Watch()
+	minigameRegistry = registry
+
+	http.HandleFunc("/admin/minigames", requireAdmin(registry.ServeHTTP))
+
+	return nil
+}
+
+func (r *MinigameRegistry) reload() error {
+	var file minigameFile
+	if _, err := toml.DecodeFile(r.path, &file); err != nil {
+		return err
+	}
+
+	byGameRoom := make(map[string][]*Minigame)
+	for gameName, game := range file.Game {
+		for roomId, room := range game.Room {
+			key := gameName + "/" + roomId
+
+			for _, cfg := range room.Minigames {
+				byGameRoom[key] = append(byGameRoom[key], &Minigame{
+					Id:             cfg.Id,
+					VarId:          cfg.VarId,
+					InitialVarSync: cfg.InitialVarSync,
+					SwitchId:       cfg.SwitchId,
+					SwitchValue:    cfg.SwitchValue,
+					Dev:            cfg.Dev,
+				})
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.byGameRoom = byGameRoom
+	r.mu.Unlock()
+
+	return nil
+}
+
+// writeAndReload writes data to a temp file in the same directory and
+// renames it over r.path only once the write succeeds, so a crash or full
+// disk mid-write can't leave a half-written file where a good config used to
+// be; then reloads from the now-updated path.
+func (r *MinigameRegistry) writeAndReload(data []byte) error {
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, r.path); err != nil {
+		return err
+	}
+
+	return r.reload()
+}
+
+// Watch reloads the registry whenever the process receives SIGHUP, logging
+// (but not dying on) a bad config so a typo doesn't take down minigames.
+func (r *MinigameRegistry) Watch() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	go func() {
+		for range sighup {
+			if err := r.reload(); err != nil {
+				log.Println("minigames: reload failed, keeping previous config:", err)
+			} else {
+				log.Println("minigames: reloaded from", r.path)
+			}
+		}
+	}()
+}
+
+// forRoom returns nil if called before InitMinigames has loaded a registry,
+// rather than panicking, so a startup-order mistake degrades to "no
+// minigames" instead of crashing every room-data request.
+func (r *MinigameRegistry) forRoom(gameName string, roomId int) []*Minigame {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.byGameRoom[gameName+"/"+strconv.Itoa(roomId)]
+}
+
+// requireAdmin rejects the request unless the caller's token resolves to an
+// admin-ranked player, mirroring the rank check already used to gate session
+// privileges (see client.rank in session.go).
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, _, rank, _, banned, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
+		if banned || rank < rankAdmin {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// ServeHTTP handles GET/PUT /admin/minigames: GET dumps the whole file on
+// disk, PUT overwrites it and reloads, so minigames can be managed without a
+// SIGHUP from the shell.
+func (r *MinigameRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		data, err := os.ReadFile(r.path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/toml")
+		w.Write(data)
+	case http.MethodPut:
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Decode into a scratch value before touching the file on disk, so a
+		// malformed upload is rejected without leaving the live config
+		// (which LoadMinigames/InitMinigames will read again on next
+		// restart) corrupted.
+		var scratch minigameFile
+		if _, err := toml.Decode(string(data), &scratch); err != nil {
+			http.Error(w, "invalid TOML: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := r.writeAndReload(data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
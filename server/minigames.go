@@ -26,21 +26,10 @@ type Minigame struct {
 	Dev            bool   `json:"dev"`
 }
 
+// minigameRegistry is populated by InitMinigames at startup from
+// minigames.toml, which holds the per-game/per-room minigame data.
+var minigameRegistry *MinigameRegistry
+
 func getRoomMinigames(roomId int) (minigames []*Minigame) {
-	switch serverConfig.GameName {
-	case "yume":
-		if roomId == 155 {
-			minigames = append(minigames, &Minigame{Id: "nasu", VarId: 88, SwitchId: 215})
-		}
-	case "2kki":
-		switch roomId {
-		case 102:
-			minigames = append(minigames, &Minigame{Id: "rby", VarId: 1010, InitialVarSync: true})
-		case 618:
-			minigames = append(minigames, &Minigame{Id: "rby_ex", VarId: 79, InitialVarSync: true})
-		case 344:
-			minigames = append(minigames, &Minigame{Id: "fuji_ex", VarId: 3218, SwitchId: 3219, SwitchValue: true})
-		}
-	}
-	return minigames
+	return minigameRegistry.forRoom(serverConfig.GameName, roomId)
 }
@@ -19,13 +19,16 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode/utf8"
-
-	"github.com/gorilla/websocket"
 )
 
 var (
@@ -34,14 +37,32 @@ var (
 )
 
 type Session struct {
-	lastId int
+	lastId  int
+	backend SessionBackend
 }
 
 func initSession() {
+	if serverConfig.ClusterBackend == "redis" {
+		hostname, _ := os.Hostname()
+		nodeId := fmt.Sprintf("%s-%d", hostname, os.Getpid())
+
+		session.backend = NewRedisSessionBackend(serverConfig.ClusterRedisAddr, serverConfig.GameName, nodeId)
+	} else {
+		session.backend = NewLocalSessionBackend()
+	}
+
+	if err := session.backend.Start(); err != nil {
+		log.Println("sessionbackend: failed to start, falling back to local:", err)
+		session.backend = NewLocalSessionBackend()
+	}
+
 	scheduler.Every(5).Seconds().Do(func() {
 		session.broadcast("pc", getSessionClientsLen())
 		sendPartyUpdate()
 	})
+
+	initRateLimitMetrics()
+	initChatFilters()
 }
 
 func handleSession(w http.ResponseWriter, r *http.Request) {
@@ -51,20 +72,106 @@ func handleSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var playerToken string
-	if token, ok := r.URL.Query()["token"]; ok && len(token[0]) == 32 {
-		playerToken = token[0]
+	session.addClient(NewWebSocketTransport(conn), getIp(r), playerToken(r))
+}
+
+// handleEvents is the SSE counterpart to handleSession, for clients behind
+// proxies that strip the websocket upgrade. Broadcasts (s, pc, gsay, pt) flow
+// down the stream; client->server messages arrive separately via
+// handleEventsSend since an event stream is one-directional.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	transport, err := NewSSETransport(w)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(sseHeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-transport.closed:
+				return
+			case <-ticker.C:
+				transport.heartbeat()
+			}
+		}
+	}()
+
+	client := session.addClient(transport, getIp(r), playerToken(r))
+	if client == nil {
+		transport.Close()
+		return
 	}
 
-	session.addClient(conn, getIp(r), playerToken)
+	// Bind/Resume need client.uuid, which addClient has only just resolved,
+	// so a reconnecting client replays what it missed from its own history
+	// record rather than the empty one a brand-new transport would start with.
+	transport.Bind(client.uuid)
+	if lastEventId, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil {
+		transport.Resume(lastEventId)
+	}
+
+	<-r.Context().Done()
+	transport.Close()
 }
 
-func (s *Session) addClient(conn *websocket.Conn, ip string, token string) {
+// handleEventsSend accepts the client->server half of an SSE session. The
+// uuid query parameter identifies which SSETransport to deliver the body to,
+// but uuid alone is not a credential: GET /events carries its own in
+// gsay/psay/s broadcasts, so anyone can read a player's uuid off the wire.
+// The caller must also present the X-Send-Token GET /events handed back,
+// which only the player holding that SSE connection ever saw.
+func handleEventsSend(w http.ResponseWriter, r *http.Request) {
+	uuid := r.URL.Query().Get("uuid")
+
+	clientAny, ok := clients.Load(uuid)
+	if !ok {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+
+	sseTransport, ok := clientAny.(*SessionClient).transport.(*SSETransport)
+	if !ok {
+		http.Error(w, "session is not using SSE", http.StatusBadRequest)
+		return
+	}
+
+	if !sseTransport.Authorize(r.Header.Get("X-Send-Token")) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	sseTransport.Enqueue(data)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func playerToken(r *http.Request) string {
+	if token, ok := r.URL.Query()["token"]; ok && len(token[0]) == 32 {
+		return token[0]
+	}
+	return ""
+}
+
+// addClient returns the created client, or nil if the connection was
+// rejected (banned, duplicate session, too many connections from ip). The
+// SSE handler needs the resolved uuid back to bind its transport's replay
+// history, which isn't known until this function resolves the token.
+func (s *Session) addClient(transport Transport, ip string, token string) *SessionClient {
 	client := &SessionClient{
-		conn: conn,
-		ip:   ip,
-		send: make(chan []byte, 16),
-		receive: make(chan []byte, 16),
+		transport: transport,
+		ip:        ip,
+		send:      make(chan []byte, 16),
+		receive:   make(chan []byte, 16),
+		limiter:   newClientLimiter(),
 	}
 
 	var banned bool
@@ -80,12 +187,12 @@ func (s *Session) addClient(conn *websocket.Conn, ip string, token string) {
 
 	if banned {
 		writeErrLog(ip, "session", "player is banned")
-		return
+		return nil
 	}
 
 	if _, ok := clients.Load(client.uuid); ok {
 		writeErrLog(ip, "session", "session already exists for uuid")
-		return
+		return nil
 	}
 
 	var sameIp int
@@ -98,7 +205,7 @@ func (s *Session) addClient(conn *websocket.Conn, ip string, token string) {
 	})
 	if sameIp >= 3 {
 		writeErrLog(ip, "session", "too many connections from ip")
-		return
+		return nil
 	}
 
 	if client.badge == "" {
@@ -109,6 +216,7 @@ func (s *Session) addClient(conn *websocket.Conn, ip string, token string) {
 	s.lastId++
 
 	client.spriteName, client.spriteIndex, client.systemName = getPlayerGameData(client.uuid)
+	client.shadowmuted = getPlayerShadowmuted(client.uuid)
 
 	// register client to the clients list
 	clients.Store(client.uuid, client)
@@ -122,9 +230,22 @@ func (s *Session) addClient(conn *websocket.Conn, ip string, token string) {
 	go client.msgReader()
 
 	writeLog(ip, "session", "connect", 200)
+
+	return client
 }
 
+// broadcast sends segments to every client on this node and fans it out to
+// sibling nodes via the configured SessionBackend so clustered deployments
+// reach players connected to a different node.
 func (s *Session) broadcast(segments ...any) {
+	s.broadcastLocal(segments...)
+	s.backend.Publish(segments...)
+}
+
+// broadcastLocal sends segments only to clients connected to this node. It is
+// also what SessionBackend implementations call when mirroring a message that
+// originated on a sibling node, so it doesn't get republished in a loop.
+func (s *Session) broadcastLocal(segments ...any) {
 	clients.Range(func(_, v any) bool {
 		v.(*SessionClient).sendMsg(segments...)
 
@@ -164,6 +285,25 @@ func (s *Session) processMsg(msgStr string, sender *SessionClient) (err error) {
 		return err
 	}
 
+	if !sender.rateLimitAllow(msgFields[0]) {
+		return errors.New("rate limit exceeded")
+	}
+
+	if (msgFields[0] == "gsay" || msgFields[0] == "psay") && len(msgFields) > 1 {
+		allowed, filtered := checkChatFilters(sender, msgFields[1])
+		if !allowed {
+			return nil
+		}
+		msgFields[1] = filtered
+
+		// Shadowmuted players see their own messages as normal so the mute
+		// isn't obvious, but nobody else receives them.
+		if sender.shadowmuted {
+			sender.sendMsg(msgFields[0], sender.uuid, filtered)
+			return nil
+		}
+	}
+
 	switch msgFields[0] {
 	case "i": // player info
 		err = s.handleI(sender)
@@ -196,7 +336,25 @@ func (s *Session) processMsg(msgStr string, sender *SessionClient) (err error) {
 	return nil
 }
 
+// getSessionClientsLen returns the number of clients connected to this node
+// plus, when clustering is enabled, the aggregate count reported by sibling
+// nodes through the SessionBackend's presence heartbeats.
 func getSessionClientsLen() int {
+	length := getLocalSessionClientsLen()
+
+	if session.backend != nil {
+		length += session.backend.ClientCount()
+	}
+
+	return length
+}
+
+// getLocalSessionClientsLen returns only the clients connected to this node,
+// excluding any sibling-node presence reported by the SessionBackend. This is
+// what a SessionBackend must publish as its own heartbeat, since publishing
+// the aggregate (via getSessionClientsLen) would compound every sibling's
+// already-published total back into its presence key on every heartbeat cycle.
+func getLocalSessionClientsLen() int {
 	var length int
 
 	clients.Range(func(_, _ any) bool {
@@ -0,0 +1,237 @@
+/*
+	Copyright (C) 2021-2022  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// remoteClient describes a SessionClient connected to a sibling node. Nothing
+// builds or reads one: no map of remote clients is kept, broadcast() reaches
+// sibling nodes through SessionBackend.Publish, and remote presence is counted
+// only through ClientCount.
+type remoteClient struct {
+	uuid   string
+	nodeId string
+}
+
+// SessionBackend lets Session fan broadcasts and presence out across multiple
+// ynoserver instances sitting behind a load balancer. LocalSessionBackend is a
+// no-op implementation used when clustering isn't configured.
+type SessionBackend interface {
+	Start() error
+	Close() error
+
+	// Publish fans a broadcast segment set out to sibling nodes.
+	Publish(segments ...any)
+
+	// ClientCount returns the number of clients connected to sibling nodes
+	// (not including this node's own clients sync.Map).
+	ClientCount() int
+}
+
+// LocalSessionBackend is the original single-node behavior: broadcasts never
+// leave the process and there is no remote presence to account for.
+type LocalSessionBackend struct{}
+
+func NewLocalSessionBackend() *LocalSessionBackend {
+	return &LocalSessionBackend{}
+}
+
+func (b *LocalSessionBackend) Start() error { return nil }
+func (b *LocalSessionBackend) Close() error { return nil }
+
+func (b *LocalSessionBackend) Publish(segments ...any) {}
+
+func (b *LocalSessionBackend) ClientCount() int { return 0 }
+
+const (
+	redisHeartbeatInterval = 5 * time.Second
+	redisHeartbeatTtl      = 15 * time.Second
+	redisReconnectBackoff  = 2 * time.Second
+)
+
+// RedisSessionBackend publishes gsay/psay/pt/pc events over Redis Pub/Sub,
+// keyed by game name, and tracks remote presence as one Redis key per node
+// (nodeId's own clientCount with its own TTL) so a crashed node's count
+// expires on its own schedule instead of lingering as long as any other
+// node keeps the shared key's TTL refreshed.
+type RedisSessionBackend struct {
+	gameName string
+	nodeId   string
+	rdb      *redis.Client
+	pubsub   *redis.PubSub
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func NewRedisSessionBackend(addr string, gameName string, nodeId string) *RedisSessionBackend {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &RedisSessionBackend{
+		gameName: gameName,
+		nodeId:   nodeId,
+		rdb:      redis.NewClient(&redis.Options{Addr: addr}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+func (b *RedisSessionBackend) channel() string {
+	return "ynoserver:session:" + b.gameName
+}
+
+// presenceKey is a per-node key with its own TTL, rather than a field in a
+// shared hash: a shared hash's TTL gets refreshed by every node's heartbeat,
+// so a crashed node's last-published count would never expire as long as any
+// other node stayed alive. A per-node key expires on its own regardless of
+// what other nodes are doing.
+func (b *RedisSessionBackend) presenceKey() string {
+	return "ynoserver:presence:" + b.gameName + ":" + b.nodeId
+}
+
+func (b *RedisSessionBackend) presenceKeyPattern() string {
+	return "ynoserver:presence:" + b.gameName + ":*"
+}
+
+func (b *RedisSessionBackend) Start() error {
+	b.pubsub = b.rdb.Subscribe(b.ctx, b.channel())
+	if _, err := b.pubsub.Receive(b.ctx); err != nil {
+		return err
+	}
+
+	go b.readLoop()
+	go b.heartbeatLoop()
+
+	return nil
+}
+
+func (b *RedisSessionBackend) Close() error {
+	b.cancel()
+	if b.pubsub != nil {
+		b.pubsub.Close()
+	}
+	b.rdb.Del(context.Background(), b.presenceKey())
+	return b.rdb.Close()
+}
+
+type redisMsg struct {
+	NodeId   string `json:"nodeId"`
+	Segments []any  `json:"segments"`
+}
+
+func (b *RedisSessionBackend) Publish(segments ...any) {
+	payload, err := json.Marshal(redisMsg{NodeId: b.nodeId, Segments: segments})
+	if err != nil {
+		log.Println("sessionbackend: marshal failed:", err)
+		return
+	}
+
+	if err := b.rdb.Publish(b.ctx, b.channel(), payload).Err(); err != nil {
+		log.Println("sessionbackend: publish failed:", err)
+	}
+}
+
+func (b *RedisSessionBackend) ClientCount() int {
+	var total int
+	ownKey := b.presenceKey()
+
+	iter := b.rdb.Scan(b.ctx, 0, b.presenceKeyPattern(), 0).Iterator()
+	for iter.Next(b.ctx) {
+		key := iter.Val()
+		if key == ownKey {
+			continue
+		}
+
+		countStr, err := b.rdb.Get(b.ctx, key).Result()
+		if err != nil {
+			continue // key expired between SCAN and GET; skip it
+		}
+
+		var count int
+		if err := json.Unmarshal([]byte(countStr), &count); err == nil {
+			total += count
+		}
+	}
+	if err := iter.Err(); err != nil {
+		log.Println("sessionbackend: presence scan failed:", err)
+	}
+
+	return total
+}
+
+// readLoop reconnects with a fixed backoff when the subscription drops, and
+// mirrors every message from a sibling node back into broadcastLocal() so
+// players on this node see gsay/psay/pt/pc traffic from the whole cluster.
+func (b *RedisSessionBackend) readLoop() {
+	ch := b.pubsub.Channel()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				time.Sleep(redisReconnectBackoff)
+				b.pubsub = b.rdb.Subscribe(b.ctx, b.channel())
+				ch = b.pubsub.Channel()
+				continue
+			}
+
+			var parsed redisMsg
+			if err := json.Unmarshal([]byte(msg.Payload), &parsed); err != nil {
+				continue
+			}
+			if parsed.NodeId == b.nodeId {
+				continue // our own publish, echoed back by Redis
+			}
+
+			session.broadcastLocal(parsed.Segments...)
+		}
+	}
+}
+
+func (b *RedisSessionBackend) heartbeatLoop() {
+	ticker := time.NewTicker(redisHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+			// getLocalSessionClientsLen, not getSessionClientsLen: the latter
+			// already includes every sibling's last-published total, and
+			// publishing that back under our own key would compound the
+			// aggregate every cycle.
+			count, err := json.Marshal(getLocalSessionClientsLen())
+			if err != nil {
+				continue
+			}
+
+			if err := b.rdb.Set(b.ctx, b.presenceKey(), count, redisHeartbeatTtl).Err(); err != nil {
+				log.Println("sessionbackend: heartbeat failed:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+/*
+	Copyright (C) 2021-2022  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedisBackend(t *testing.T, nodeId string) (*RedisSessionBackend, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("failed to start miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+
+	b := NewRedisSessionBackend(mr.Addr(), "testgame", nodeId)
+	if err := b.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	return b, mr
+}
+
+func TestRedisSessionBackendPublishMirrorsToSiblings(t *testing.T) {
+	nodeA, mr := newTestRedisBackend(t, "node-a")
+
+	nodeB := NewRedisSessionBackend(mr.Addr(), "testgame", "node-b")
+	if err := nodeB.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer nodeB.Close()
+
+	// Subscribe separately: nodeB's own readLoop drains nodeB.pubsub.Channel()
+	// and would race this test for the message.
+	sub := nodeB.rdb.Subscribe(context.Background(), nodeB.channel())
+	defer sub.Close()
+	if _, err := sub.Receive(context.Background()); err != nil {
+		t.Fatalf("Subscribe() failed: %v", err)
+	}
+
+	received := make(chan []byte, 1)
+
+	go func() {
+		for msg := range sub.Channel() {
+			received <- []byte(msg.Payload)
+			return
+		}
+	}()
+
+	nodeA.Publish("gsay", "hello")
+
+	select {
+	case payload := <-received:
+		if len(payload) == 0 {
+			t.Fatal("expected a non-empty published payload")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for publish to reach sibling node")
+	}
+}
+
+func TestRedisSessionBackendClientCountAggregatesOtherNodesOnly(t *testing.T) {
+	nodeA, mr := newTestRedisBackend(t, "node-a")
+
+	mr.Set("ynoserver:presence:testgame:node-a", "5")
+	mr.Set("ynoserver:presence:testgame:node-b", "3")
+	mr.Set("ynoserver:presence:testgame:node-c", "2")
+
+	if got, want := nodeA.ClientCount(), 5; got != want {
+		t.Errorf("ClientCount() = %d, want %d (node-b + node-c, excluding self)", got, want)
+	}
+}
+
+func TestRedisSessionBackendPresenceExpires(t *testing.T) {
+	nodeA, mr := newTestRedisBackend(t, "node-a")
+
+	mr.Set("ynoserver:presence:testgame:node-b", "7")
+	mr.SetTTL("ynoserver:presence:testgame:node-b", redisHeartbeatTtl)
+
+	if got, want := nodeA.ClientCount(), 7; got != want {
+		t.Fatalf("ClientCount() before expiry = %d, want %d", got, want)
+	}
+
+	mr.FastForward(redisHeartbeatTtl + time.Second)
+
+	if got, want := nodeA.ClientCount(), 0; got != want {
+		t.Errorf("ClientCount() after expiry = %d, want %d; a crashed node's count should not linger", got, want)
+	}
+}
+
+func TestRedisSessionBackendStartFailsOnUnreachableAddr(t *testing.T) {
+	b := NewRedisSessionBackend("127.0.0.1:1", "testgame", "node-a")
+
+	if err := b.Start(); err == nil {
+		t.Fatal("Start() against an unreachable address should return an error, not hang or panic")
+	}
+}
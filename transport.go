@@ -0,0 +1,283 @@
+/*
+	Copyright (C) 2021-2022  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport abstracts the wire a SessionClient talks over, so msgWriter and
+// msgReader don't need to know whether they're driving a websocket.Conn or an
+// SSE stream. handleSession and handleEvents each build their own
+// implementation and hand it to addClient.
+type Transport interface {
+	// ReadMsg blocks for the next client->server message. SSETransport
+	// implementations source this from the companion POST /events/send queue.
+	ReadMsg() ([]byte, error)
+
+	// WriteMsg pushes a server->client message down the wire.
+	WriteMsg(data []byte) error
+
+	Close() error
+}
+
+// WebSocketTransport is the original transport, unchanged in behavior.
+type WebSocketTransport struct {
+	conn *websocket.Conn
+}
+
+func NewWebSocketTransport(conn *websocket.Conn) *WebSocketTransport {
+	return &WebSocketTransport{conn: conn}
+}
+
+func (t *WebSocketTransport) ReadMsg() ([]byte, error) {
+	_, data, err := t.conn.ReadMessage()
+	return data, err
+}
+
+func (t *WebSocketTransport) WriteMsg(data []byte) error {
+	return t.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (t *WebSocketTransport) Close() error {
+	return t.conn.Close()
+}
+
+const sseHeartbeatInterval = 15 * time.Second
+
+// SSETransport serves broadcasts (s, pc, gsay, pt) over a plain HTTP/1.1
+// event stream for clients behind proxies that block websocket upgrades.
+// Client->server messages arrive out of band through POST /events/send and
+// are buffered on the transport's own receive channel, which ReadMsg drains.
+type SSETransport struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	receive chan []byte
+	closed  chan struct{}
+
+	// sendToken is a per-connection secret, handed back from GET /events and
+	// required by POST /events/send, so a caller can't drive another
+	// player's session just by knowing their uuid off the wire.
+	sendToken string
+
+	writeMu  sync.Mutex // serializes writeFrame and heartbeat on w
+	closeMu  sync.Mutex
+	isClosed bool
+
+	// history is nil until Bind is called with the client's uuid (known
+	// only once addClient resolves the token), and is shared across
+	// reconnects so Resume can replay events written by a prior connection.
+	history *sseHistoryRecord
+}
+
+type sseEvent struct {
+	id   int
+	data []byte
+}
+
+const sseHistorySize = 64
+
+// sseHistoryRecord is the uuid-keyed, reconnect-surviving event log an
+// SSETransport appends to. Transports for the same uuid share one record, so
+// a client that reconnects with Last-Event-ID sees what it missed even
+// though its previous SSETransport instance is long gone.
+type sseHistoryRecord struct {
+	mu     sync.Mutex
+	lastId int
+	events []sseEvent
+}
+
+var sseHistories sync.Map // uuid -> *sseHistoryRecord
+
+func getSSEHistory(uuid string) *sseHistoryRecord {
+	actual, _ := sseHistories.LoadOrStore(uuid, &sseHistoryRecord{})
+	return actual.(*sseHistoryRecord)
+}
+
+func NewSSETransport(w http.ResponseWriter) (*SSETransport, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("streaming unsupported")
+	}
+
+	sendToken, err := newSendToken()
+	if err != nil {
+		return nil, err
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Send-Token", sendToken)
+
+	return &SSETransport{
+		w:         w,
+		flusher:   flusher,
+		receive:   make(chan []byte, 16),
+		closed:    make(chan struct{}),
+		sendToken: sendToken,
+	}, nil
+}
+
+func newSendToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// Bind attaches this transport to uuid's shared history record. It must be
+// called once the client's uuid is known (after session.addClient resolves
+// the token) and before Resume, or Resume has nothing to replay from.
+func (t *SSETransport) Bind(uuid string) {
+	t.history = getSSEHistory(uuid)
+}
+
+// Resume replays events with id > lastEventId, per the Last-Event-ID header,
+// so a client that reconnects after a drop doesn't miss pc/pt snapshots
+// broadcast while it was away.
+func (t *SSETransport) Resume(lastEventId int) {
+	if t.history == nil {
+		return
+	}
+
+	t.history.mu.Lock()
+	events := append([]sseEvent(nil), t.history.events...)
+	t.history.mu.Unlock()
+
+	for _, ev := range events {
+		if ev.id > lastEventId {
+			t.writeFrame(ev.id, ev.data)
+		}
+	}
+}
+
+func (t *SSETransport) ReadMsg() ([]byte, error) {
+	data, ok := <-t.receive
+	if !ok {
+		return nil, errors.New("transport closed")
+	}
+	return data, nil
+}
+
+// Authorize reports whether sendToken matches the secret this transport
+// handed back from GET /events. handleEventsSend must check this before
+// Enqueue, or any caller who reads a victim's uuid off a broadcast could
+// inject messages as them.
+func (t *SSETransport) Authorize(sendToken string) bool {
+	return sendToken != "" && sendToken == t.sendToken
+}
+
+// Enqueue is called by handleEventsSend to deliver a client->server message
+// posted out of band, since an SSE stream itself is one-directional. It's a
+// no-op once the transport has closed, since Close also closes t.receive and
+// a send on a closed channel would panic the HTTP handler goroutine.
+func (t *SSETransport) Enqueue(data []byte) {
+	t.closeMu.Lock()
+	defer t.closeMu.Unlock()
+
+	if t.isClosed {
+		return
+	}
+
+	select {
+	case t.receive <- data:
+	default:
+		// receive buffer full; drop rather than block the HTTP handler
+	}
+}
+
+func (t *SSETransport) WriteMsg(data []byte) error {
+	id := t.appendHistory(data)
+	return t.writeFrame(id, data)
+}
+
+// appendHistory records data in the shared history record (if bound) and
+// returns the event id it was assigned. Unbound transports (no uuid resolved
+// yet) tag every event with id 1 and persist nothing to replay.
+func (t *SSETransport) appendHistory(data []byte) int {
+	if t.history == nil {
+		return 1
+	}
+
+	t.history.mu.Lock()
+	defer t.history.mu.Unlock()
+
+	t.history.lastId++
+	t.history.events = append(t.history.events, sseEvent{id: t.history.lastId, data: data})
+	if len(t.history.events) > sseHistorySize {
+		t.history.events = t.history.events[len(t.history.events)-sseHistorySize:]
+	}
+
+	return t.history.lastId
+}
+
+// writeFrame and heartbeat both write to the shared http.ResponseWriter from
+// different goroutines (WriteMsg's caller vs. handleEvents' ticker), so both
+// take writeMu to avoid interleaving a heartbeat comment into the middle of
+// an id:/data: frame.
+func (t *SSETransport) writeFrame(id int, data []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	w := bufio.NewWriter(t.w)
+	if _, err := w.WriteString("id: " + strconv.Itoa(id) + "\ndata: " + string(data) + "\n\n"); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	t.flusher.Flush()
+	return nil
+}
+
+func (t *SSETransport) heartbeat() {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	w := bufio.NewWriter(t.w)
+	w.WriteString(": heartbeat\n\n")
+	w.Flush()
+	t.flusher.Flush()
+}
+
+func (t *SSETransport) Close() error {
+	t.closeMu.Lock()
+	if t.isClosed {
+		t.closeMu.Unlock()
+		return nil
+	}
+	t.isClosed = true
+	t.closeMu.Unlock()
+
+	close(t.closed)
+	close(t.receive)
+	return nil
+}